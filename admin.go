@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngenohkevin/paybutton/utils"
+)
+
+// adminAuth only lets through requests carrying "Authorization: Bearer <ADMIN_API_KEY>"
+func adminAuth(apiKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func getRuntimeStats(c *gin.Context) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	c.JSON(http.StatusOK, gin.H{
+		"goroutines":      runtime.NumGoroutine(),
+		"active_monitors": activeMonitors.Load(),
+		"memory": gin.H{
+			"heap_alloc_bytes":  memStats.HeapAlloc,
+			"heap_inuse_bytes":  memStats.HeapInuse,
+			"heap_objects":      memStats.HeapObjects,
+			"sys_bytes":         memStats.Sys,
+			"num_gc":            memStats.NumGC,
+			"gc_pause_total_ns": memStats.PauseTotalNs,
+		},
+	})
+}
+
+func sendTestEmail(c *gin.Context) {
+	recipient := c.PostForm("recipient")
+	if recipient == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input: recipient is required"})
+		return
+	}
+
+	server, err := utils.SendTestEmail(recipient)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "server": server, "message": fmt.Sprintf("Test email sent to %s", recipient)})
+}
+
+func getFailedCredits(c *gin.Context) {
+	failedCreditsMutex.Lock()
+	credits := append([]FailedCredit{}, failedCredits...)
+	failedCreditsMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"count": len(credits), "credits": credits})
+}
+
+// retryFailedCredits attempts every queued credit once and keeps the ones that still fail.
+// The queue is taken out while retrying so monitors can keep queueing new failures.
+func retryFailedCredits(c *gin.Context) {
+	failedCreditsMutex.Lock()
+	queued := failedCredits
+	failedCredits = nil
+	failedCreditsMutex.Unlock()
+
+	var remaining []FailedCredit
+	resolved := 0
+	for _, credit := range queued {
+		err := updateUserBalance(credit.Email, credit.AmountCents)
+		if err != nil {
+			credit.Error = err.Error()
+			remaining = append(remaining, credit)
+			continue
+		}
+		log.Printf("Queued credit of %s USD for user %s resolved", utils.FormatCents(credit.AmountCents), utils.MaskEmail(credit.Email))
+		resolved++
+
+		// Send the confirmation email the monitor held back when the credit failed
+		if credit.UserName != "" {
+			go func(credit FailedCredit) {
+				err := utils.SendEmail(credit.Email, credit.UserName, utils.FormatCents(credit.AmountCents))
+				if err != nil {
+					log.Printf("Error sending email to user %s: %s", utils.MaskEmail(credit.Email), err)
+				}
+			}(credit)
+		}
+	}
+	failedCreditsMutex.Lock()
+	failedCredits = append(remaining, failedCredits...)
+	failedCreditsMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"resolved": resolved, "remaining": len(remaining)})
+}
+
+func getActiveMonitors(c *gin.Context) {
+	mutex.Lock()
+	monitors := make([]gin.H, 0, len(checkingAddresses))
+	for _, monitor := range checkingAddresses {
+		remaining := monitorDuration - time.Since(monitor.StartedAt)
+		if remaining < 0 {
+			remaining = 0
+		}
+		monitors = append(monitors, gin.H{
+			"address":           monitor.Address,
+			"email":             monitor.Email,
+			"test":              monitor.Test,
+			"started_at":        monitor.StartedAt,
+			"remaining_seconds": int64(remaining.Seconds()),
+		})
+	}
+	mutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"count": len(monitors), "addresses": monitors})
+}
+
+func getUserAddresses(c *gin.Context) {
+	email := c.Param("email")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	session, exists := userSessions[email]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No session found for this email"})
+		return
+	}
+
+	addresses := make([]gin.H, 0, len(session.GeneratedAddresses))
+	active := 0
+	for addr, createdAt := range session.GeneratedAddresses {
+		used := session.UsedAddresses[addr]
+		if !used && time.Since(createdAt) <= addressExpiry {
+			active++
+		}
+		addresses = append(addresses, gin.H{"address": addr, "created_at": createdAt, "used": used})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"email":            email,
+		"active_addresses": active,
+		"address_limit":    addressLimit,
+		"limit_extended":   session.ExtendedAddressAllowed,
+		"addresses":        addresses,
+	})
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -20,14 +24,23 @@ import (
 )
 
 var (
-	botApiKey         string
-	chatID            int64 = 7933331471
-	addressLimit            = 6
-	addressExpiry           = 72 * time.Hour // Set address expiry time to 72 hours
-	blockCypherToken  string
-	checkingAddresses = make(map[string]bool)
-	db                *sql.DB
-	staticBTCAddress  = "bc1qzdhle7flgehjjr54qejhzuyxy3qpcygpzyhxuw"
+	botApiKey            string
+	chatID               int64 = 7933331471
+	addressLimit               = 6              // Addresses an email can generate before falling back, until one of them is paid
+	addressExpiry              = 72 * time.Hour // Set address expiry time to 72 hours
+	blockCypherToken     string
+	checkingAddresses    = make(map[string]MonitoredAddress)
+	monitorDuration      = 30 * time.Minute // How long a new address is polled for payment
+	db                   *sql.DB
+	staticBTCAddress     = "bc1qzdhle7flgehjjr54qejhzuyxy3qpcygpzyhxuw"
+	emailUnknownUsers    = true // Send a generic confirmation email when the user's name can't be found
+	balanceRaceProviders = 0    // Providers to query concurrently for balance checks, 0 or 1 keeps them sequential
+	verifyThresholdUSD   = 0.0  // Payments at or above this USD value must be confirmed by two providers, 0 disables
+	verifyTolerance      = 1.0  // Maximum allowed difference between providers, in percent
+	addressReuse         = true // Hand unpaid addresses back to the same email instead of generating new ones
+	balanceLogEvery      = 1    // Log every Nth zero-balance check per address
+	balanceUpdateRetries = 3    // Attempts to credit a payment before queueing it for manual resolution
+	testPaymentToken     string // Secret a request must send as test_token to be treated as a test payment
 	//staticUSDTAddress = "TJecnsMey1oj1wfSuV7FAaduuje4T3W3AE"
 )
 
@@ -38,14 +51,29 @@ type UserSession struct {
 	ExtendedAddressAllowed bool
 }
 
+// testPaymentTag prefixes Telegram notifications for test payments
+const testPaymentTag = "*TEST PAYMENT*\n"
+
 var userSessions = make(map[string]*UserSession)
 var mutex sync.Mutex
 
+// Counters for the public status summary, kept atomic so it never waits on mutex
+var (
+	startTime      = time.Now()
+	totalPayments  atomic.Int64
+	activeMonitors atomic.Int64
+	lastPaymentAt  atomic.Int64 // Unix time of the last credited payment, including test payments
+)
+
 func main() {
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+	err = payments.InitAddressBackend()
+	if err != nil {
+		log.Fatalf("Failed to initialize xpub wallet: %v", err)
+	}
 
 	botApiKey = os.Getenv("BOT_API_KEY")
 	if botApiKey == "" {
@@ -57,32 +85,84 @@ func main() {
 		log.Fatal("BLOCKCYPHER_TOKEN not set in .env file")
 	}
 
+	emailUnknownUsers = utils.GetEnvBool("EMAIL_UNKNOWN_USERS", emailUnknownUsers)
+	balanceRaceProviders = utils.GetEnvInt("BALANCE_RACE_PROVIDERS", balanceRaceProviders)
+	verifyThresholdUSD = utils.GetEnvFloat("BALANCE_VERIFY_THRESHOLD_USD", verifyThresholdUSD)
+	verifyTolerance = utils.GetEnvFloat("BALANCE_VERIFY_TOLERANCE", verifyTolerance)
+	addressReuse = utils.GetEnvBool("ADDRESS_REUSE", addressReuse)
+	balanceLogEvery = utils.GetEnvInt("BALANCE_LOG_EVERY", balanceLogEvery)
+	balanceUpdateRetries = utils.GetEnvInt("BALANCE_UPDATE_RETRIES", balanceUpdateRetries)
+	if balanceUpdateRetries < 1 {
+		balanceUpdateRetries = 1
+	}
+	utils.MaskEmails = utils.GetEnvBool("MASK_EMAILS", false)
+	addressLimit = utils.GetEnvInt("ADDRESS_LIMIT", addressLimit)
+	testPaymentToken = os.Getenv("TEST_PAYMENT_TOKEN")
+	if !addressReuse {
+		log.Printf("Address reuse disabled: every payment gets a fresh address, which increases gap limit pressure")
+	}
+
 	PostgresUser := os.Getenv("POSTGRES_USER")
 	PostgresHost := os.Getenv("POSTGRES_HOST")
 	PostgresPassword := os.Getenv("POSTGRES_PASSWORD")
 	PostgresDatabase := os.Getenv("POSTGRES_DATABASE")
 
-	db, err = sql.Open("postgres", fmt.Sprintf("user=%s host=%s password=%s dbname=%s sslmode=require", PostgresUser, PostgresHost, PostgresPassword, PostgresDatabase))
-	if err != nil {
-		log.Fatal("Error connecting to the database:", err)
-	}
-	defer func(db *sql.DB) {
-		err := db.Close()
+	dbOptional := utils.GetEnvBool("DB_OPTIONAL", false)
+
+	if PostgresHost == "" && dbOptional {
+		// Keep serving payments; balance credits are queued for manual resolution
+		log.Printf("No database configured, running without it")
+	} else {
+		db, err = sql.Open("postgres", fmt.Sprintf("user=%s host=%s password=%s dbname=%s sslmode=require", PostgresUser, PostgresHost, PostgresPassword, PostgresDatabase))
 		if err != nil {
-			return
+			log.Fatal("Error connecting to the database:", err)
+		}
+		defer func(db *sql.DB) {
+			err := db.Close()
+			if err != nil {
+				return
+			}
+		}(db)
+
+		// Later queries reconnect on their own, so an outage at startup only delays credits
+		if pingErr := db.Ping(); pingErr != nil {
+			log.Printf("Database not reachable yet: %s", pingErr)
 		}
-	}(db)
+	}
 
-	bot, err := tgbotapi.NewBotAPI(botApiKey)
+	// The default bot client has no timeout, so a hung Telegram API would stall balance monitors
+	telegramClient := &http.Client{Timeout: time.Duration(utils.GetEnvInt("TELEGRAM_TIMEOUT_SECONDS", 10)) * time.Second}
+	bot, err := tgbotapi.NewBotAPIWithClient(botApiKey, tgbotapi.APIEndpoint, telegramClient)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	telegramBatchWindow = time.Duration(utils.GetEnvInt("TELEGRAM_BATCH_SECONDS", 0)) * time.Second
+
+	if hours := utils.GetEnvInt("DEADMAN_HOURS", 0); hours > 0 {
+		activeStart := utils.GetEnvInt("DEADMAN_ACTIVE_START", 0)
+		activeEnd := utils.GetEnvInt("DEADMAN_ACTIVE_END", 24)
+		if activeStart < 0 || activeStart > 23 || activeEnd < 0 || activeEnd > 24 || activeStart == activeEnd {
+			log.Fatalf("DEADMAN_ACTIVE_START must be 0-23 and DEADMAN_ACTIVE_END 0-24 and different, got %d and %d", activeStart, activeEnd)
+		}
+		go watchPaymentActivity(bot, time.Duration(hours)*time.Hour, activeStart, activeEnd)
+	}
+
 	//updateBalanceManually() // Uncomment this to update balance manually
 
 	r := gin.Default()
 	r.Use(cors.Default())
 
+	// Behind Render/Cloudflare, ClientIP() is only correct when the proxies and their headers are trusted
+	if proxies := utils.GetEnvList("TRUSTED_PROXIES"); len(proxies) > 0 {
+		if err := r.SetTrustedProxies(proxies); err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+	}
+	if headers := utils.GetEnvList("REMOTE_IP_HEADERS"); len(headers) > 0 {
+		r.RemoteIPHeaders = headers
+	}
+
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "Payment Service API"})
 	})
@@ -91,6 +171,20 @@ func main() {
 	r.POST("/usdt", handleUsdtPayment(bot))
 	r.POST("/payment", handlePayment(bot))
 	r.GET("/balance/:address", getBalance)
+	r.GET("/status/summary", getStatusSummary)
+
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+	if adminAPIKey != "" {
+		admin := r.Group("/admin/api", adminAuth(adminAPIKey))
+		admin.GET("/debug/runtime", getRuntimeStats)
+		admin.POST("/email/test", sendTestEmail)
+		admin.GET("/credits/failed", getFailedCredits)
+		admin.POST("/credits/failed/retry", retryFailedCredits)
+		admin.GET("/monitoring/active", getActiveMonitors)
+		admin.GET("/users/:email", getUserAddresses)
+	} else {
+		log.Printf("ADMIN_API_KEY not set, admin endpoints are disabled")
+	}
 
 	err = r.Run()
 	if err != nil {
@@ -140,8 +234,6 @@ func getBalance(c *gin.Context) {
 		})
 		return
 	}
-	btc := float64(balance) / 100000000
-
 	rate, err := utils.GetBlockonomicsRate()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -150,12 +242,17 @@ func getBalance(c *gin.Context) {
 		return
 	}
 
-	balanceUSD := btc * rate
-	balanceUSDFormatted := fmt.Sprintf("%.2f", balanceUSD)
-
 	c.JSON(http.StatusOK, gin.H{
 		"address": address,
-		"balance": balanceUSDFormatted,
+		"balance": utils.FormatCents(utils.SatoshisToCents(balance, rate)),
+	})
+}
+
+func getStatusSummary(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"uptime_seconds":  int64(time.Since(startTime).Seconds()),
+		"total_payments":  totalPayments.Load(),
+		"active_monitors": activeMonitors.Load(),
 	})
 }
 
@@ -187,6 +284,12 @@ func processPaymentRequest(c *gin.Context, bot *tgbotapi.BotAPI, generateBtcAddr
 	priceStr := c.PostForm("price")
 	description := c.PostForm("description")
 	name := c.PostForm("name")
+	// Test payments run the normal flow but are tagged in notifications and left out of payment counts
+	testPayment := c.PostForm("test") == "true"
+	if testPayment && (testPaymentToken == "" || subtle.ConstantTimeCompare([]byte(c.PostForm("test_token")), []byte(testPaymentToken)) != 1) {
+		log.Printf("Ignoring test flag from %s without a valid test token", clientIP)
+		testPayment = false
+	}
 
 	if email == "" || priceStr == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input: email and price are required"})
@@ -199,6 +302,13 @@ func processPaymentRequest(c *gin.Context, bot *tgbotapi.BotAPI, generateBtcAddr
 		return
 	}
 
+	// Look for a reusable address before taking the lock for the rest of the request,
+	// since checking its balance means calling out to the providers
+	var reusableAddress string
+	if generateBtcAddress && addressReuse {
+		reusableAddress = getReusableAddress(email, bot)
+	}
+
 	mutex.Lock()
 	defer mutex.Unlock()
 
@@ -215,9 +325,13 @@ func processPaymentRequest(c *gin.Context, bot *tgbotapi.BotAPI, generateBtcAddr
 
 	var address string
 	if generateBtcAddress {
-		// Attempt to get a reusable address
-		address, err = getReusableAddress(session)
-		if err != nil || address == "" {
+		// Another request may have used the address while the lock was released
+		if reusableAddress != "" && !session.UsedAddresses[reusableAddress] {
+			if _, ok := session.GeneratedAddresses[reusableAddress]; ok {
+				address = reusableAddress
+			}
+		}
+		if address == "" {
 			// No reusable address found, generate a new one if limit not reached
 			addressLimitReached := len(session.GeneratedAddresses) >= addressLimit
 			if addressLimitReached {
@@ -240,22 +354,16 @@ func processPaymentRequest(c *gin.Context, bot *tgbotapi.BotAPI, generateBtcAddr
 					address = fallbackToStaticAddress()
 				} else {
 					session.GeneratedAddresses[address] = time.Now()
-					log.Printf("Generated new address: %s for email: %s", address, email)
-					if !checkingAddresses[address] {
-						checkingAddresses[address] = true
-						go checkBalancePeriodically(address, email, blockCypherToken, bot)
-					}
+					log.Printf("Generated new address: %s for email: %s", address, utils.MaskEmail(email))
+					startMonitoring(address, email, testPayment, bot)
 				}
 			} else {
-				log.Printf("Address generation limit reached for user %s. Reusing address if available.", email)
+				log.Printf("Address generation limit reached for user %s. Reusing address if available.", utils.MaskEmail(email))
 				address = fallbackToStaticAddress()
 			}
 		} else {
-			log.Printf("Reused address: %s for email: %s", address, email)
-			if !checkingAddresses[address] {
-				checkingAddresses[address] = true
-				go checkBalancePeriodically(address, email, blockCypherToken, bot)
-			}
+			log.Printf("Reused address: %s for email: %s", address, utils.MaskEmail(email))
+			startMonitoring(address, email, testPayment, bot)
 		}
 	} else if generateUsdtAddress {
 		randomUsdtAddress := utils.RandomUSDTAddress()
@@ -276,20 +384,27 @@ func processPaymentRequest(c *gin.Context, bot *tgbotapi.BotAPI, generateBtcAddr
 		log.Printf("Error parsing local time: %s", err)
 	}
 
-	logMessage := fmt.Sprintf("Email: %s, Address: %s, Amount: %.2f, Name: %s, Product: %s", email, address, priceUSD, name, description)
+	logMessage := fmt.Sprintf("Email: %s, Address: %s, Amount: %.2f, Name: %s, Product: %s", utils.MaskEmail(email), address, priceUSD, name, description)
 	log.Printf(logMessage)
 
 	botLogMessage := fmt.Sprintf(
 		"*Email:* `%s`\n*Address:* `%s`\n*Amount:* `%0.2f`\n*Name:* `%s`\n*Product:* `%s`\n*IP Address:* `%s`\n*Country:* `%s`\n*State:* `%s`\n*City:* `%s`\n*Local Time:* `%s`",
 		email, address, priceUSD, name, description, clientIP, ipAPIData.Location.Country, ipAPIData.Location.State, ipAPIData.Location.City, localTime)
+	if testPayment {
+		botLogMessage = testPaymentTag + botLogMessage
+	}
 
-	msg := tgbotapi.NewMessage(chatID, botLogMessage)
-	msg.ParseMode = tgbotapi.ModeMarkdown
-	_, err = bot.Send(msg)
-	if err != nil {
-		log.Printf("Error sending message to user: %s", err)
+	currency := "BTC"
+	if generateUsdtAddress {
+		currency = "USDT"
+	}
+	explorerURL := utils.ExplorerURL(currency, address)
+	if explorerURL != "" {
+		botLogMessage += fmt.Sprintf("\n*Explorer:* [View on explorer](%s)", explorerURL)
 	}
 
+	sendRoutineMessage(bot, botLogMessage)
+
 	responseData := gin.H{
 		"address":     address,
 		"priceInUSD":  priceUSD,
@@ -298,6 +413,10 @@ func processPaymentRequest(c *gin.Context, bot *tgbotapi.BotAPI, generateBtcAddr
 		"expired_at":  utils.GetExpiryTime(),
 		"description": description,
 		"name":        name,
+		"test":        testPayment,
+	}
+	if explorerURL != "" {
+		responseData["explorer_url"] = explorerURL
 	}
 
 	if generateBtcAddress {
@@ -310,14 +429,58 @@ func processPaymentRequest(c *gin.Context, bot *tgbotapi.BotAPI, generateBtcAddr
 	c.JSON(http.StatusOK, responseData)
 }
 
-func getReusableAddress(session *UserSession) (string, error) {
+// reuseCheckTimeout bounds the balance check made before reusing an address
+const reuseCheckTimeout = 5 * time.Second
+
+// getReusableAddress returns an unused, unexpired address generated earlier for email, or "" if there is none.
+// It takes mutex itself and releases it while querying balances.
+func getReusableAddress(email string, bot *tgbotapi.BotAPI) string {
+	mutex.Lock()
+	session, exists := userSessions[email]
+	if !exists {
+		mutex.Unlock()
+		return ""
+	}
+	var candidates []string
 	for addr, createdAt := range session.GeneratedAddresses {
 		// Check if the address is not used and has not expired
-		if !session.UsedAddresses[addr] && time.Since(createdAt) <= addressExpiry {
-			return addr, nil
+		if session.UsedAddresses[addr] || time.Since(createdAt) > addressExpiry {
+			continue
+		}
+		// A running monitor already picks up any payment into the address
+		if _, ok := checkingAddresses[addr]; ok {
+			mutex.Unlock()
+			return addr
 		}
+		candidates = append(candidates, addr)
 	}
-	return "", fmt.Errorf("no reusable address found")
+	mutex.Unlock()
+
+	for _, addr := range candidates {
+		// The customer may already have paid into this address after its monitor stopped,
+		// so check the balance before handing it back as a blank reservation
+		// This runs while the customer waits, so make one short attempt and don't retry
+		ctx, cancel := context.WithTimeout(context.Background(), reuseCheckTimeout)
+		balance, err := payments.GetBitcoinAddressBalanceWithBlockChain(ctx, addr)
+		cancel()
+		if err != nil {
+			// The address may already be funded, so don't hand it out unchecked
+			log.Printf("Error checking balance before reusing address %s, skipping it: %s", addr, err)
+			continue
+		}
+		if balance > 0 {
+			log.Printf("Address %s already received %d satoshis, not reusing it", addr, balance)
+			mutex.Lock()
+			session.UsedAddresses[addr] = true
+			// Make sure the existing payment is picked up and credited
+			startMonitoring(addr, email, false, bot)
+			mutex.Unlock()
+			continue
+		}
+
+		return addr
+	}
+	return ""
 }
 
 func fallbackToStaticAddress() string {
@@ -326,11 +489,32 @@ func fallbackToStaticAddress() string {
 	return staticBTCAddress
 }
 
+// MonitoredAddress describes an address whose balance is being polled
+type MonitoredAddress struct {
+	Address   string    `json:"address"`
+	Email     string    `json:"email"`
+	Test      bool      `json:"test"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// startMonitoring starts a balance monitor for address unless one is already running; callers must hold mutex
+func startMonitoring(address, email string, test bool, bot *tgbotapi.BotAPI) {
+	if _, ok := checkingAddresses[address]; ok {
+		return
+	}
+	checkingAddresses[address] = MonitoredAddress{Address: address, Email: email, Test: test, StartedAt: time.Now()}
+	go checkBalancePeriodically(address, email, blockCypherToken, bot)
+}
+
 func checkBalancePeriodically(address, email, token string, bot *tgbotapi.BotAPI) {
-	checkDuration := 30 * time.Minute
 	ticker := time.NewTicker(60 * time.Second)
 	defer ticker.Stop()
-	timeout := time.After(checkDuration)
+	timeout := time.After(monitorDuration)
+	disagreementReported := false
+	polls := 0
+
+	activeMonitors.Add(1)
+	defer activeMonitors.Add(-1)
 
 	for {
 		select {
@@ -342,28 +526,56 @@ func checkBalancePeriodically(address, email, token string, bot *tgbotapi.BotAPI
 				continue
 			}
 
-			log.Printf("Address: %s, Balance: %d satoshis", address, balance)
+			polls++
+			// Routine zero-balance checks are sampled; a detected balance is always logged
+			if balance > 0 || balanceLogEvery <= 1 || polls%balanceLogEvery == 1 {
+				log.Printf("Address: %s, Balance: %d satoshis (check %d)", address, balance, polls)
+			}
 			if balance > 0 {
 				rate, err := utils.GetBlockonomicsRate()
 				if err != nil {
 					log.Printf("Error fetching rate: %s", err)
 				}
 
-				balanceUSD := float64(balance) / 100000000 * rate
-				balanceUSD = roundToTwoDecimalPlaces(balanceUSD)
+				// Work in whole cents so rounding can't drift amounts or threshold comparisons
+				balanceCents := utils.SatoshisToCents(balance, rate)
+				balanceUSD := utils.FormatCents(balanceCents)
+
+				if verifyThresholdUSD > 0 && balanceCents >= utils.DollarsToCents(verifyThresholdUSD) {
+					verified, err := verifyBalanceAcrossProviders(address, token)
+					if err != nil {
+						log.Printf("Balance for address %s not verified, continuing to poll: %s", address, err)
+						if !disagreementReported {
+							disagreementReported = true
+							sendBotMessage(bot, fmt.Sprintf(
+								"*Balance Not Verified:* `%s`\n*Email:* `%s`\n*Amount:* `%s USD`\n*Reason:* `%s`",
+								address, email, balanceUSD, err))
+						}
+						continue
+					}
+					// Credit what the providers agreed on rather than the first provider's answer
+					balanceCents = utils.SatoshisToCents(verified, rate)
+					balanceUSD = utils.FormatCents(balanceCents)
+				}
 
 				var userName string
-				err = db.QueryRow("SELECT name FROM users WHERE email = $1", email).Scan(&userName)
-				if err != nil {
-					log.Printf("Error fetching user name for email %s: %s", email, err)
-					continue
+				if db != nil {
+					err = db.QueryRow("SELECT name FROM users WHERE email = $1", email).Scan(&userName)
+					if err != nil {
+						log.Printf("Error fetching user name for email %s: %s", utils.MaskEmail(email), err)
+						userName = ""
+					}
 				}
 
-				err = updateUserBalance(email, balanceUSD)
+				err = creditUserBalance(email, userName, address, balanceCents)
+				credited := err == nil
 				if err != nil {
-					log.Printf("Error updating balance for user %s: %s", email, err)
+					log.Printf("Error updating balance for user %s, queued for manual resolution: %s", utils.MaskEmail(email), err)
+					sendBotMessage(bot, fmt.Sprintf(
+						"*Balance Credit Failed:* `%s`\n*Email:* `%s`\n*Amount:* `%s USD`\n*Error:* `%s`",
+						address, email, balanceUSD, err))
 				} else {
-					log.Printf("Balance updated successfully for user %s", email)
+					log.Printf("Balance updated successfully for user %s", utils.MaskEmail(email))
 				}
 				// comment this to update manually
 				mutex.Lock()
@@ -372,34 +584,62 @@ func checkBalancePeriodically(address, email, token string, bot *tgbotapi.BotAPI
 				if len(session.UsedAddresses) > 0 && !session.ExtendedAddressAllowed {
 					session.ExtendedAddressAllowed = true
 				}
+				testPayment := checkingAddresses[address].Test
 				delete(checkingAddresses, address)
 				mutex.Unlock()
+				if !testPayment {
+					totalPayments.Add(1)
+				}
+				// A payment that couldn't be credited doesn't count, so a broken database still trips the alert
+				if credited {
+					lastPaymentAt.Store(time.Now().Unix())
+				}
 
 				confirmationTime := time.Now().Format(time.RFC3339)
 				botLogMessage := fmt.Sprintf(
 					"*Email:* `%s`\n*New Balance Added:* `%s USD`\n*Confirmation Time:* `%s`",
-					email, fmt.Sprintf("%.2f", balanceUSD), confirmationTime)
+					email, balanceUSD, confirmationTime)
+				if testPayment {
+					botLogMessage = testPaymentTag + botLogMessage
+				}
+				if explorerURL := utils.ExplorerURL("BTC", address); explorerURL != "" {
+					botLogMessage += fmt.Sprintf("\n*Explorer:* [View on explorer](%s)", explorerURL)
+				}
 
-				msg := tgbotapi.NewMessage(chatID, botLogMessage)
-				msg.ParseMode = tgbotapi.ModeMarkdown
-				_, err = bot.Send(msg)
-				if err != nil {
-					log.Printf("Error sending confirmation message to bot: %s", err)
+				sendRoutineMessage(bot, botLogMessage)
+
+				if userName == "" {
+					if !emailUnknownUsers {
+						log.Printf("Skipping confirmation email for unknown user %s", utils.MaskEmail(email))
+						return
+					}
+					// There is no account to credit, so confirm the payment itself rather than a balance
+					log.Println("Sending payment received email to unknown user:", utils.MaskEmail(email))
+					err = utils.SendPaymentReceivedEmail(email, balanceUSD)
+					if err != nil {
+						log.Printf("Error sending email to user %s: %s", utils.MaskEmail(email), err)
+					}
+					return
+				}
+				// The email tells the user the amount is in their balance, which is only true once credited
+				if !credited {
+					log.Printf("Holding confirmation email for user %s until the queued credit is retried", utils.MaskEmail(email))
+					return
 				}
 
-				log.Println("Sending confirmation email to user:", email)
-				err = utils.SendEmail(email, userName, fmt.Sprintf("%.2f", balanceUSD))
+				log.Println("Sending confirmation email to user:", utils.MaskEmail(email))
+				err = utils.SendEmail(email, userName, balanceUSD)
 				if err != nil {
-					log.Printf("Error sending email to user %s: %s", email, err)
+					log.Printf("Error sending email to user %s: %s", utils.MaskEmail(email), err)
 				} else {
-					log.Println("Confirmation email sent successfully to user:", email)
+					log.Println("Confirmation email sent successfully to user:", utils.MaskEmail(email))
 				}
 
 				return
 			}
 
 		case <-timeout:
-			log.Printf("Stopped checking balance for address %s after %v", address, checkDuration)
+			log.Printf("Stopped checking balance for address %s after %v", address, monitorDuration)
 			mutex.Lock()
 			delete(checkingAddresses, address)
 			mutex.Unlock()
@@ -408,41 +648,246 @@ func checkBalancePeriodically(address, email, token string, bot *tgbotapi.BotAPI
 	}
 }
 
-func getBitcoinAddressBalanceWithFallback(address, token string) (int64, error) {
-	balance, err := payments.GetBitcoinAddressBalanceWithBlockonomics(address)
-	if err != nil {
-		log.Printf("Error with Blockonomics, trying Blockchain: %s", err)
-		balance, err = payments.GetBitcoinAddressBalanceWithBlockChain(address)
-		if err != nil {
-			log.Printf("Error with Blockchain, trying BlockCypher: %s", err)
-			balance, err = payments.GetBitcoinAddressBalanceWithBlockCypher(address, token)
+type balanceProvider struct {
+	name  string
+	fetch func(ctx context.Context, address, token string) (int64, error)
+}
+
+// balanceProviders lists the balance APIs in order of preference
+var balanceProviders = []balanceProvider{
+	{"Blockonomics", func(ctx context.Context, address, _ string) (int64, error) {
+		return payments.GetBitcoinAddressBalanceWithBlockonomics(ctx, address)
+	}},
+	{"Blockchain", func(ctx context.Context, address, _ string) (int64, error) {
+		return payments.GetBitcoinAddressBalanceWithBlockChain(ctx, address)
+	}},
+	{"BlockCypher", payments.GetBitcoinAddressBalanceWithBlockCypher},
+}
+
+// getBitcoinAddressBalanceRace queries the first n providers concurrently and returns the first
+// non-zero balance, or zero once every provider has answered without finding funds.
+// The remaining requests are cancelled as soon as it returns.
+func getBitcoinAddressBalanceRace(address, token string, n int) (int64, error) {
+	if n > len(balanceProviders) {
+		n = len(balanceProviders)
+	}
+
+	type result struct {
+		provider string
+		balance  int64
+		err      error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Buffered so cancelled providers can still report after we have returned
+	results := make(chan result, n)
+	for _, provider := range balanceProviders[:n] {
+		go func(p balanceProvider) {
+			balance, err := p.fetch(ctx, address, token)
+			results <- result{provider: p.name, balance: balance, err: err}
+		}(provider)
+	}
+
+	var lastErr error
+	succeeded := false
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil {
+			log.Printf("Error with %s during concurrent balance check: %s", r.provider, r.err)
+			lastErr = r.err
+			continue
 		}
-		if err != nil {
-			log.Printf("Error with BlockCypher, using static address: %s", err)
-			balance, err = payments.GetBitcoinAddressBalanceWithBlockChain(staticBTCAddress)
+		if r.balance > 0 {
+			return r.balance, nil
 		}
+		succeeded = true
+	}
+	if succeeded {
+		return 0, nil
 	}
-	return balance, err
+	return 0, lastErr
 }
 
-// update balance for user
-func updateUserBalance(email string, newBalanceUSD float64) error {
-	var currentBalance float64
-	err := db.QueryRow("SELECT balance FROM users WHERE email = $1", email).Scan(&currentBalance)
+// verifyBalanceAcrossProviders checks that the first two providers agree on the balance of address
+// and returns the lower of the two balances
+func verifyBalanceAcrossProviders(address, token string) (int64, error) {
+	first, second := balanceProviders[0], balanceProviders[1]
+
+	firstBalance, err := first.fetch(context.Background(), address, token)
 	if err != nil {
-		return fmt.Errorf("error fetching current balance for user %s: %w", email, err)
+		return 0, fmt.Errorf("%s: %w", first.name, err)
+	}
+	secondBalance, err := second.fetch(context.Background(), address, token)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", second.name, err)
 	}
 
-	updatedBalance := roundToTwoDecimalPlaces(currentBalance + newBalanceUSD)
+	largest := math.Max(float64(firstBalance), float64(secondBalance))
+	if largest == 0 {
+		return 0, fmt.Errorf("no balance confirmed: %s and %s both report 0 satoshis", first.name, second.name)
+	}
+	difference := math.Abs(float64(firstBalance - secondBalance))
+	if difference/largest*100 > verifyTolerance {
+		return 0, fmt.Errorf("providers disagree: %s reports %d satoshis, %s reports %d satoshis",
+			first.name, firstBalance, second.name, secondBalance)
+	}
 
-	_, err = db.Exec("UPDATE users SET balance = $1 WHERE email = $2", updatedBalance, email)
-	if err != nil {
-		return fmt.Errorf("error updating balance for user %s: %w", email, err)
+	if firstBalance < secondBalance {
+		return firstBalance, nil
 	}
+	return secondBalance, nil
+}
 
-	return nil
+// watchPaymentActivity sends a critical alert when no payment has been credited for longer than silence.
+// Only time between activeStart and activeEnd (UTC hours) counts towards silence, and the window
+// wraps past midnight when activeStart is after activeEnd. It alerts once per silent stretch.
+func watchPaymentActivity(bot *tgbotapi.BotAPI, silence time.Duration, activeStart, activeEnd int) {
+	lastPaymentAt.CompareAndSwap(0, startTime.Unix())
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	trackedFor := lastPaymentAt.Load()
+	lastTick := time.Now()
+	var silentFor time.Duration
+	alerted := false
+	for now := range ticker.C {
+		last := lastPaymentAt.Load()
+		if last != trackedFor {
+			trackedFor = last
+			silentFor = 0
+			alerted = false
+		}
+
+		// Count the time since the previous tick, or since the payment if it came in between
+		from := lastTick
+		if paidAt := time.Unix(last, 0); paidAt.After(from) {
+			from = paidAt
+		}
+		lastTick = now
+		if !isActiveHour(now.UTC().Hour(), activeStart, activeEnd) {
+			continue
+		}
+		silentFor += now.Sub(from)
+		if alerted || silentFor < silence {
+			continue
+		}
+
+		alerted = true
+		log.Printf("No payments credited in %v of active hours, sending dead man's switch alert", silentFor.Round(time.Minute))
+		sendBotMessage(bot, fmt.Sprintf(
+			"*CRITICAL: No Payments Processed*\n*Last Payment:* `%s`\n*Silent For:* `%v`\n*Active Monitors:* `%d`",
+			time.Unix(last, 0).Format(time.RFC3339), silentFor.Round(time.Minute), activeMonitors.Load()))
+	}
+}
+
+// isActiveHour reports whether hour falls in [start, end), wrapping past midnight when start > end
+func isActiveHour(hour, start, end int) bool {
+	if start <= end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+func getBitcoinAddressBalanceWithFallback(address, token string) (int64, error) {
+	remaining := balanceProviders
+	if balanceRaceProviders > 1 {
+		balance, err := getBitcoinAddressBalanceRace(address, token, balanceRaceProviders)
+		if err == nil {
+			return balance, nil
+		}
+		// Every raced provider has already failed, so only the rest are tried in turn
+		raced := balanceRaceProviders
+		if raced > len(balanceProviders) {
+			raced = len(balanceProviders)
+		}
+		log.Printf("Concurrent balance check failed, falling back to remaining providers: %s", err)
+		remaining = balanceProviders[raced:]
+	}
+
+	for _, provider := range remaining {
+		balance, err := provider.fetch(context.Background(), address, token)
+		if err == nil {
+			return balance, nil
+		}
+		log.Printf("Error with %s: %s", provider.name, err)
+	}
+
+	log.Printf("Error with all balance providers, using static address")
+	return payments.GetBitcoinAddressBalanceWithBlockChain(context.Background(), staticBTCAddress)
+}
+
+// FailedCredit is a paid amount that could not be added to the user's balance
+type FailedCredit struct {
+	Email       string    `json:"email"`
+	UserName    string    `json:"user_name"` // Empty for unknown users, who get no balance email
+	Address     string    `json:"address"`
+	AmountCents int64     `json:"amount_cents"`
+	Error       string    `json:"error"`
+	FailedAt    time.Time `json:"failed_at"`
 }
 
-func roundToTwoDecimalPlaces(value float64) float64 {
-	return math.Round(value*100) / 100
+// failedCredits has its own lock so admin requests don't wait behind address generation
+var (
+	failedCredits      []FailedCredit
+	failedCreditsMutex sync.Mutex
+)
+
+// Credit errors that retrying cannot fix
+var (
+	errNoDatabase   = errors.New("database not available")
+	errUserNotFound = errors.New("no user found")
+)
+
+// creditUserBalance retries updateUserBalance with a linear backoff and queues the
+// credit for manual resolution if every attempt fails. userName is kept so the confirmation
+// email can be sent once the queued credit goes through.
+func creditUserBalance(email, userName, address string, amountCents int64) error {
+	err := updateUserBalance(email, amountCents)
+	for attempt := 1; err != nil; attempt++ {
+		log.Printf("Error updating balance for user %s (attempt %d/%d): %s", utils.MaskEmail(email), attempt, balanceUpdateRetries, err)
+		if attempt >= balanceUpdateRetries || errors.Is(err, errNoDatabase) || errors.Is(err, errUserNotFound) {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		err = updateUserBalance(email, amountCents)
+	}
+	if err == nil {
+		return nil
+	}
+
+	failedCreditsMutex.Lock()
+	failedCredits = append(failedCredits, FailedCredit{
+		Email:       email,
+		UserName:    userName,
+		Address:     address,
+		AmountCents: amountCents,
+		Error:       err.Error(),
+		FailedAt:    time.Now(),
+	})
+	failedCreditsMutex.Unlock()
+	return err
+}
+
+// update balance for user
+func updateUserBalance(email string, amountCents int64) error {
+	if db == nil {
+		return fmt.Errorf("%w, balance of %s USD for user %s was not credited", errNoDatabase, utils.FormatCents(amountCents), utils.MaskEmail(email))
+	}
+
+	// Add in a single statement so concurrent credits can't overwrite each other,
+	// passing the amount as an exact decimal string rather than a float
+	result, err := db.Exec("UPDATE users SET balance = balance + $1::numeric WHERE email = $2", utils.FormatCents(amountCents), email)
+	if err != nil {
+		return fmt.Errorf("error updating balance for user %s: %w", utils.MaskEmail(email), err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking balance update for user %s: %w", utils.MaskEmail(email), err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w with email %s", errUserNotFound, utils.MaskEmail(email))
+	}
+
+	return nil
 }
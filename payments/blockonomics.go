@@ -2,10 +2,12 @@ package payments
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/joho/godotenv"
+	"github.com/ngenohkevin/paybutton/utils"
 	"io"
 	"log"
 	"net/http"
@@ -22,18 +24,24 @@ type httpClient struct {
 }
 
 var (
-	blockonomicsAPIKey string
-	httpClientInstance *httpClient
+	blockonomicsAPIKey  string
+	blockonomicsRetries int
+	httpClientInstance  *httpClient
 )
 
 func init() {
 	err := godotenv.Load(".env")
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Printf("Error loading .env file: %s", err)
 	}
 
 	blockonomicsAPIKey = os.Getenv("BLOCKONOMICS_API_KEY")
 	proxyURL := os.Getenv("PROXY_URL")
+	timeout := time.Duration(utils.GetEnvInt("BLOCKONOMICS_TIMEOUT_SECONDS", 10)) * time.Second
+	blockonomicsRetries = utils.GetEnvInt("BLOCKONOMICS_RETRIES", 2)
+	if blockonomicsRetries < 0 {
+		blockonomicsRetries = 0
+	}
 
 	// Configure the transport with or without proxy
 	transport := &http.Transport{
@@ -52,12 +60,70 @@ func init() {
 	httpClientInstance = &httpClient{
 		client: &http.Client{
 			Transport: transport,
-			Timeout:   time.Second * 10,
+			Timeout:   timeout,
 		},
 	}
 }
 
+// doBlockonomicsRequest sends an authorized request to the Blockonomics API. Idempotent requests
+// are retried on network errors and 5xx responses with exponential backoff; others are sent once,
+// since a timed out request may still have been processed. Cancelling ctx stops the request and any retries.
+func doBlockonomicsRequest(ctx context.Context, method, apiUrl string, payload []byte, idempotent bool) (*http.Response, error) {
+	retries := blockonomicsRetries
+	if !idempotent {
+		retries = 0
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<(attempt-1)) * time.Second // 1, 2, 4 seconds
+			log.Printf("Retrying Blockonomics request to %s in %v (attempt %d/%d): %s", apiUrl, backoff, attempt, retries, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		req, reqErr := http.NewRequestWithContext(ctx, method, apiUrl, bytes.NewReader(payload))
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", blockonomicsAPIKey))
+		req.Header.Set("Content-Type", "application/json")
+
+		var resp *http.Response
+		resp, err = httpClientInstance.client.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			err = fmt.Errorf("status code: %v, body: %s", resp.StatusCode, string(body))
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// GenerateBitcoinAddress returns a fresh address from the local xpub wallet if configured, otherwise from Blockonomics
 func GenerateBitcoinAddress(email string, price float64) (string, error) {
+	if walletService != nil {
+		address, err := walletService.GenerateAddress()
+		if err != nil {
+			return "", err
+		}
+		log.Printf("Derived address %s for email: %s, price: %.2f USD", address, utils.MaskEmail(email), price)
+		return address, nil
+	}
+
+	return generateBlockonomicsAddress(email, price)
+}
+
+func generateBlockonomicsAddress(email string, price float64) (string, error) {
 	addrUrl := "https://www.blockonomics.co/api/new_address"
 
 	// Create a unique label using the user's email address and a timestamp
@@ -73,55 +139,31 @@ func GenerateBitcoinAddress(email string, price float64) (string, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", addrUrl, bytes.NewBuffer(payload))
+	// Every new_address call reserves an address, so it is never retried
+	resp, err := doBlockonomicsRequest(context.Background(), "POST", addrUrl, payload, false)
 	if err != nil {
 		return "", err
 	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", blockonomicsAPIKey))
-	req.Header.Set("Content-Type", "application/json")
-
-	respChan := make(chan *http.Response)
-	errChan := make(chan error)
-
-	go func() {
-		resp, err := httpClientInstance.client.Do(req)
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
 		if err != nil {
-			errChan <- err
-			return
-		}
-		respChan <- resp
-	}()
-
-	select {
-	case resp := <-respChan:
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-
-			}
-		}(resp.Body)
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			return "", fmt.Errorf("error generating bitcoin address, status code: %v, body: %s", resp.StatusCode, string(body))
 		}
+	}(resp.Body)
 
-		var addressResponse AddressResponse
-		if err := json.NewDecoder(resp.Body).Decode(&addressResponse); err != nil {
-			return "", err
-		}
-
-		if addressResponse.Address == "" {
-			return "", errors.New("empty address returned")
-		}
-
-		return addressResponse.Address, nil
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("error generating bitcoin address, status code: %v, body: %s", resp.StatusCode, string(body))
+	}
 
-	case err := <-errChan:
+	var addressResponse AddressResponse
+	if err := json.NewDecoder(resp.Body).Decode(&addressResponse); err != nil {
 		return "", err
+	}
 
-	case <-time.After(time.Second * 30):
-		return "", errors.New("timed out waiting for API response")
+	if addressResponse.Address == "" {
+		return "", errors.New("empty address returned")
 	}
+
+	return addressResponse.Address, nil
 }
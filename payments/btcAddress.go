@@ -1,180 +1,206 @@
 package payments
 
-//import (
-//	"encoding/json"
-//	"errors"
-//	"fmt"
-//	"github.com/btcsuite/btcd/btcutil"
-//	"github.com/btcsuite/btcd/btcutil/hdkeychain"
-//	"github.com/btcsuite/btcd/chaincfg"
-//	"github.com/joho/godotenv"
-//	"log"
-//	"os"
-//	"sync"
-//	"time"
-//)
-//
-//type AddressResponse struct {
-//	Address string `json:"address"`
-//}
-//
-//var (
-//	bitcoinXpub   string
-//	walletService *WalletService
-//	initOnce      sync.Once
-//)
-//
-//// WalletService manages Bitcoin address generation
-//type WalletService struct {
-//	xpub         string
-//	currentIndex int
-//	mu           sync.Mutex
-//	netParams    *chaincfg.Params
-//	storage      *PersistentStorage
-//}
-//
-//type PersistentStorage struct {
-//	filePath string
-//	mu       sync.Mutex
-//}
-//
-//func NewPersistentStorage(filePath string) *PersistentStorage {
-//	return &PersistentStorage{filePath: filePath}
-//}
-//
-//func (ps *PersistentStorage) LoadIndex() (int, error) {
-//	ps.mu.Lock()
-//	defer ps.mu.Unlock()
-//
-//	file, err := os.Open(ps.filePath)
-//	if err != nil {
-//		if os.IsNotExist(err) {
-//			return 0, nil // Start at index 0 if the file doesn't exist
-//		}
-//		return 0, err
-//	}
-//	defer file.Close()
-//
-//	var index int
-//	err = json.NewDecoder(file).Decode(&index)
-//	if err != nil {
-//		return 0, err
-//	}
-//
-//	return index, nil
-//}
-//
-//func (ps *PersistentStorage) SaveIndex(index int) error {
-//	ps.mu.Lock()
-//	defer ps.mu.Unlock()
-//
-//	file, err := os.Create(ps.filePath)
-//	if err != nil {
-//		return err
-//	}
-//	defer file.Close()
-//
-//	return json.NewEncoder(file).Encode(index)
-//}
-//
-//// Initialize loads environment variables and sets up the WalletService
-//func Initialize() {
-//	initOnce.Do(func() {
-//		err := godotenv.Load(".env")
-//		if err != nil {
-//			log.Fatal("Error loading .env file")
-//		}
-//
-//		bitcoinXpub = os.Getenv("BLOCKCHAIN_XPUB")
-//		if bitcoinXpub == "" {
-//			log.Fatal("BLOCKCHAIN_XPUB environment variable is required")
-//		}
-//
-//		walletService, err = NewWalletService(bitcoinXpub, &chaincfg.MainNetParams)
-//		if err != nil {
-//			log.Fatalf("Failed to initialize wallet service: %v", err)
-//		}
-//	})
-//}
-//
-//// NewWalletService initializes a WalletService with an xpub and network parameters
-//func NewWalletService(xpub string, netParams *chaincfg.Params) (*WalletService, error) {
-//	storage := NewPersistentStorage("wallet_index.json")
-//	index, err := storage.LoadIndex()
-//	if err != nil {
-//		return nil, fmt.Errorf("failed to load index: %v", err)
-//	}
-//
-//	return &WalletService{
-//		xpub:         xpub,
-//		currentIndex: index,
-//		netParams:    netParams,
-//		storage:      storage,
-//	}, nil
-//}
-//
-//// validateXpub checks if the provided xpub is valid and matches the network
-//func validateXpub(xpub string, netParams *chaincfg.Params) error {
-//	extKey, err := hdkeychain.NewKeyFromString(xpub)
-//	if err != nil {
-//		return fmt.Errorf("failed to parse xpub: %v", err)
-//	}
-//	if !extKey.IsForNet(netParams) {
-//		return errors.New("xpub does not match the specified network")
-//	}
-//	return nil
-//}
-//
-//// GenerateBitcoinAddress derives a native SegWit Bitcoin address
-//func GenerateBitcoinAddress(email string, price float64) (string, error) {
-//	Initialize()
-//
-//	// Create a label (used only for logging or tracking, not affecting address)
-//	label := fmt.Sprintf("%s-%d", email, time.Now().Unix())
-//	log.Printf("Generating address for label: %s, price: %.8f BTC", label, price)
-//
-//	address, err := walletService.GenerateAddress()
-//	if err != nil {
-//		return "", fmt.Errorf("failed to generate Bitcoin address: %v", err)
-//	}
-//
-//	return address, nil
-//}
-//
-//// GenerateAddress derives the next native SegWit (Bech32) address
-//func (w *WalletService) GenerateAddress() (string, error) {
-//	w.mu.Lock()
-//	defer w.mu.Unlock()
-//
-//	// Parse the extended public key (xpub)
-//	extKey, err := hdkeychain.NewKeyFromString(w.xpub)
-//	if err != nil {
-//		return "", fmt.Errorf("invalid xpub: %v", err)
-//	}
-//
-//	// Derive the next child key
-//	childKey, err := extKey.Derive(uint32(w.currentIndex))
-//	if err != nil {
-//		return "", fmt.Errorf("failed to derive child key: %v", err)
-//	}
-//
-//	// Extract public key and create address
-//	pubKey, err := childKey.ECPubKey()
-//	if err != nil {
-//		return "", fmt.Errorf("failed to get public key: %v", err)
-//	}
-//	witnessProg := btcutil.Hash160(pubKey.SerializeCompressed())
-//	address, err := btcutil.NewAddressWitnessPubKeyHash(witnessProg, w.netParams)
-//	if err != nil {
-//		return "", fmt.Errorf("failed to create address: %v", err)
-//	}
-//
-//	// Save the updated index
-//	w.currentIndex++
-//	err = w.storage.SaveIndex(w.currentIndex)
-//	if err != nil {
-//		return "", fmt.Errorf("failed to save index: %v", err)
-//	}
-//
-//	return address.EncodeAddress(), nil
-//}
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+var walletService *WalletService // Set when ADDRESS_BACKEND=xpub
+
+// InitAddressBackend sets up the xpub wallet when ADDRESS_BACKEND=xpub, otherwise addresses keep
+// coming from Blockonomics. It must be called after the environment has been loaded.
+func InitAddressBackend() error {
+	if strings.ToLower(os.Getenv("ADDRESS_BACKEND")) != "xpub" {
+		return nil
+	}
+
+	indexFile := os.Getenv("XPUB_INDEX_FILE")
+	if indexFile == "" {
+		indexFile = "wallet_index.json"
+	}
+	wallet, err := NewWalletService(os.Getenv("BLOCKCHAIN_XPUB"), &chaincfg.MainNetParams, NewPersistentStorage(indexFile))
+	if err != nil {
+		return err
+	}
+	walletService = wallet
+	log.Printf("Generating addresses from xpub, next index %d", wallet.currentIndex)
+	return nil
+}
+
+// addressType is the kind of address a wallet derives, chosen from its extended key version so the
+// addresses match the ones the operator's wallet scans
+type addressType int
+
+const (
+	legacyAddress       addressType = iota // xpub/tpub, BIP44 P2PKH (1...)
+	nestedSegwitAddress                    // ypub/upub, BIP49 P2SH-P2WPKH (3...)
+	nativeSegwitAddress                    // zpub/vpub, BIP84 P2WPKH (bc1q...)
+)
+
+// segwitPubKeyVersions are the SLIP-0132 versions of BIP49 and BIP84 public keys, which chaincfg doesn't know about
+var segwitPubKeyVersions = map[string]struct{ nested, native []byte }{
+	chaincfg.MainNetParams.Name:  {nested: []byte{0x04, 0x9d, 0x7c, 0xb2}, native: []byte{0x04, 0xb2, 0x47, 0x46}},
+	chaincfg.TestNet3Params.Name: {nested: []byte{0x04, 0x4a, 0x52, 0x62}, native: []byte{0x04, 0x5f, 0x1c, 0xf6}},
+}
+
+// addressTypeForKey returns the address type matching the version of extKey, or an error if extKey
+// is not an extended public key for netParams
+func addressTypeForKey(extKey *hdkeychain.ExtendedKey, netParams *chaincfg.Params) (addressType, error) {
+	version := extKey.Version()
+	segwitVersions, ok := segwitPubKeyVersions[netParams.Name]
+	switch {
+	case bytes.Equal(version, netParams.HDPublicKeyID[:]):
+		return legacyAddress, nil
+	case ok && bytes.Equal(version, segwitVersions.nested):
+		return nestedSegwitAddress, nil
+	case ok && bytes.Equal(version, segwitVersions.native):
+		return nativeSegwitAddress, nil
+	}
+	return 0, fmt.Errorf("extended public key is not for %s", netParams.Name)
+}
+
+// WalletService derives receive addresses locally from an extended public key,
+// so address generation does not depend on Blockonomics or its gap limit
+type WalletService struct {
+	externalChain *hdkeychain.ExtendedKey
+	addressType   addressType
+	currentIndex  uint32
+	mu            sync.Mutex
+	netParams     *chaincfg.Params
+	storage       *PersistentStorage
+}
+
+// PersistentStorage keeps the next derivation index on disk so restarts never reuse an address
+type PersistentStorage struct {
+	filePath string
+	mu       sync.Mutex
+}
+
+func NewPersistentStorage(filePath string) *PersistentStorage {
+	return &PersistentStorage{filePath: filePath}
+}
+
+func (ps *PersistentStorage) LoadIndex() (uint32, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	data, err := os.ReadFile(ps.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil // Start at index 0 if the file doesn't exist
+		}
+		return 0, err
+	}
+
+	var index uint32
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return 0, err
+	}
+
+	return index, nil
+}
+
+func (ps *PersistentStorage) SaveIndex(index uint32) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a truncated index behind
+	tmpPath := ps.filePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, ps.filePath)
+}
+
+// NewWalletService initializes a WalletService with an xpub, ypub or zpub and network parameters
+func NewWalletService(xpub string, netParams *chaincfg.Params, storage *PersistentStorage) (*WalletService, error) {
+	extKey, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse xpub: %v", err)
+	}
+	if extKey.IsPrivate() {
+		return nil, errors.New("an extended public key is required, refusing to use a private key")
+	}
+	addrType, err := addressTypeForKey(extKey, netParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive addresses live on the external chain of the account, e.g. m/84'/0'/0'/0/i
+	externalChain, err := extKey.Derive(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive external chain: %v", err)
+	}
+
+	index, err := storage.LoadIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load index: %v", err)
+	}
+
+	return &WalletService{
+		externalChain: externalChain,
+		addressType:   addrType,
+		currentIndex:  index,
+		netParams:     netParams,
+		storage:       storage,
+	}, nil
+}
+
+// GenerateAddress derives the next address of the type matching the wallet's extended key
+func (w *WalletService) GenerateAddress() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Derive the next child key
+	childKey, err := w.externalChain.Derive(w.currentIndex)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive child key: %v", err)
+	}
+
+	// Extract public key and create address
+	pubKey, err := childKey.ECPubKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to get public key: %v", err)
+	}
+	pubKeyHash := btcutil.Hash160(pubKey.SerializeCompressed())
+	var address btcutil.Address
+	switch w.addressType {
+	case legacyAddress:
+		address, err = btcutil.NewAddressPubKeyHash(pubKeyHash, w.netParams)
+	case nestedSegwitAddress:
+		// The P2SH redeem script is the P2WPKH witness program: OP_0 followed by the 20-byte key hash
+		redeemScript := append([]byte{0x00, 0x14}, pubKeyHash...)
+		address, err = btcutil.NewAddressScriptHash(redeemScript, w.netParams)
+	default:
+		address, err = btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, w.netParams)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create address: %v", err)
+	}
+
+	// Save the updated index before handing the address out
+	err = w.storage.SaveIndex(w.currentIndex + 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to save index: %v", err)
+	}
+	w.currentIndex++
+
+	return address.EncodeAddress(), nil
+}
@@ -0,0 +1,100 @@
+package payments
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// Account 0 public keys and first two receive addresses from the BIP44, BIP49 and BIP84 test vectors
+// (mnemonic "abandon abandon ... about")
+var walletVectors = []struct {
+	name      string
+	key       string
+	addresses []string
+}{
+	{
+		name:      "BIP44 xpub",
+		key:       "xpub6BosfCnifzxcFwrSzQiqu2DBVTshkCXacvNsWGYJVVhhawA7d4R5WSWGFNbi8Aw6ZRc1brxMyWMzG3DSSSSoekkudhUd9yLb6qx39T9nMdj",
+		addresses: []string{"1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA", "1Ak8PffB2meyfYnbXZR9EGfLfFZVpzJvQP"},
+	},
+	{
+		name:      "BIP49 ypub",
+		key:       "ypub6Ww3ibxVfGzLrAH1PNcjyAWenMTbbAosGNB6VvmSEgytSER9azLDWCxoJwW7Ke7icmizBMXrzBx9979FfaHxHcrArf3zbeJJJUZPf663zsP",
+		addresses: []string{"37VucYSaXLCAsxYyAPfbSi9eh4iEcbShgf", "3LtMnn87fqUeHBUG414p9CWwnoV6E2pNKS"},
+	},
+	{
+		name:      "BIP84 zpub",
+		key:       "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs",
+		addresses: []string{"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+	},
+}
+
+func TestGenerateAddress(t *testing.T) {
+	for _, tt := range walletVectors {
+		storage := NewPersistentStorage(filepath.Join(t.TempDir(), "wallet_index.json"))
+		wallet, err := NewWalletService(tt.key, &chaincfg.MainNetParams, storage)
+		if err != nil {
+			t.Fatalf("%s: NewWalletService: %v", tt.name, err)
+		}
+
+		for _, want := range tt.addresses {
+			got, err := wallet.GenerateAddress()
+			if err != nil {
+				t.Fatalf("%s: GenerateAddress: %v", tt.name, err)
+			}
+			if got != want {
+				t.Errorf("%s: GenerateAddress = %s, want %s", tt.name, got, want)
+			}
+		}
+
+		// A restarted service must continue after the addresses already handed out
+		restarted, err := NewWalletService(tt.key, &chaincfg.MainNetParams, storage)
+		if err != nil {
+			t.Fatalf("%s: NewWalletService after restart: %v", tt.name, err)
+		}
+		if restarted.currentIndex != uint32(len(tt.addresses)) {
+			t.Errorf("%s: currentIndex after restart = %d, want %d", tt.name, restarted.currentIndex, len(tt.addresses))
+		}
+	}
+}
+
+func TestNewWalletServiceRejectsWrongKeys(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x01}, hdkeychain.RecommendedSeedLen)
+
+	testnetMaster, err := hdkeychain.NewMaster(seed, &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatalf("NewMaster: %v", err)
+	}
+	tpub, err := testnetMaster.Neuter()
+	if err != nil {
+		t.Fatalf("Neuter: %v", err)
+	}
+	vpub, err := tpub.CloneWithVersion([]byte{0x04, 0x5f, 0x1c, 0xf6})
+	if err != nil {
+		t.Fatalf("CloneWithVersion: %v", err)
+	}
+	mainnetMaster, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("NewMaster: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"testnet public key", tpub.String()},
+		{"testnet BIP84 public key", vpub.String()},
+		{"private key", mainnetMaster.String()},
+		{"invalid key", "not-an-xpub"},
+	}
+	for _, tt := range tests {
+		storage := NewPersistentStorage(filepath.Join(t.TempDir(), "wallet_index.json"))
+		if _, err := NewWalletService(tt.key, &chaincfg.MainNetParams, storage); err == nil {
+			t.Errorf("%s: NewWalletService succeeded, want error", tt.name)
+		}
+	}
+}
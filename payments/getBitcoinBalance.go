@@ -1,6 +1,7 @@
 package payments
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,7 +24,7 @@ type BlockChainBalanceResponse struct {
 	TotalReceived int64  `json:"total_received"`
 }
 
-func GetBitcoinAddressBalanceWithBlockCypher(address, token string) (int64, error) {
+func GetBitcoinAddressBalanceWithBlockCypher(ctx context.Context, address, token string) (int64, error) {
 	url := fmt.Sprintf("https://api.blockcypher.com/v1/btc/main/addrs/%s/balance?token=%s", address, token)
 
 	var balanceResponse BlockCypherBalance
@@ -32,7 +33,12 @@ func GetBitcoinAddressBalanceWithBlockCypher(address, token string) (int64, erro
 
 	retries := 3
 	for i := 0; i < retries; i++ {
-		resp, err = http.Get(url)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err = http.DefaultClient.Do(req)
 		if err != nil {
 			return 0, err
 		}
@@ -61,7 +67,11 @@ func GetBitcoinAddressBalanceWithBlockCypher(address, token string) (int64, erro
 			if i == retries-1 {
 				return 0, err
 			}
-			time.Sleep(time.Duration(2<<i) * time.Second) // Exponential backoff: 2, 4, 8 seconds
+			select {
+			case <-time.After(time.Duration(2<<i) * time.Second): // Exponential backoff: 2, 4, 8 seconds
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
 		} else {
 			body, _ := io.ReadAll(resp.Body)
 			err := resp.Body.Close()
@@ -77,12 +87,16 @@ func GetBitcoinAddressBalanceWithBlockCypher(address, token string) (int64, erro
 	return totalBalance, nil
 }
 
-func GetBitcoinAddressBalanceWithBlockChain(address string) (int64, error) {
+func GetBitcoinAddressBalanceWithBlockChain(ctx context.Context, address string) (int64, error) {
 	url := fmt.Sprintf("https://blockchain.info/rawaddr/%s", address)
 
 	// Create an HTTP client with a timeout to prevent hanging
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return 0, fmt.Errorf("failed to fetch balance: %w", err)
 	}
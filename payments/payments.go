@@ -1,7 +1,7 @@
 package payments
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,7 +14,7 @@ type BalanceResponse struct {
 	Unconfirmed int64  `json:"unconfirmed"`
 }
 
-func GetBitcoinAddressBalanceWithBlockonomics(address string) (int64, error) {
+func GetBitcoinAddressBalanceWithBlockonomics(ctx context.Context, address string) (int64, error) {
 	url := "https://www.blockonomics.co/api/balance"
 
 	data := map[string]interface{}{
@@ -26,16 +26,7 @@ func GetBitcoinAddressBalanceWithBlockonomics(address string) (int64, error) {
 		return 0, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	if err != nil {
-		return 0, err
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", blockonomicsAPIKey))
-	req.Header.Set("Content-Type", "application/json")
-
-	//client := &http.Client{}
-	resp, err := httpClientInstance.client.Do(req)
+	resp, err := doBlockonomicsRequest(ctx, "POST", url, payload, true)
 	if err != nil {
 		return 0, err
 	}
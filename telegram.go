@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramMessageLimit is the maximum length of a single Telegram message
+const telegramMessageLimit = 4096
+
+// Routine notifications are collected here for a digest when TELEGRAM_BATCH_SECONDS is set.
+// Critical alerts are sent with sendBotMessage directly and never wait for a batch.
+var (
+	telegramBatchWindow time.Duration
+	pendingMessages     []string
+	pendingMutex        sync.Mutex
+)
+
+// sendRoutineMessage sends a Markdown message to the operator chat, or queues it for the
+// next digest when batching is enabled
+func sendRoutineMessage(bot *tgbotapi.BotAPI, text string) {
+	if telegramBatchWindow <= 0 {
+		sendBotMessage(bot, text)
+		return
+	}
+
+	pendingMutex.Lock()
+	pendingMessages = append(pendingMessages, text)
+	if len(pendingMessages) == 1 {
+		time.AfterFunc(telegramBatchWindow, func() { flushPendingMessages(bot) })
+	}
+	pendingMutex.Unlock()
+}
+
+// flushPendingMessages combines queued messages into as few digests as Telegram's length limit allows
+func flushPendingMessages(bot *tgbotapi.BotAPI) {
+	pendingMutex.Lock()
+	pending := pendingMessages
+	pendingMessages = nil
+	pendingMutex.Unlock()
+
+	if len(pending) == 1 {
+		sendBotMessage(bot, pending[0])
+		return
+	}
+
+	// Split into parts that fit the limit, leaving room for the longest possible header
+	headerRoom := len(digestHeader(len(pending)))
+	var parts [][]string
+	var current []string
+	size := headerRoom
+	for _, text := range pending {
+		if len(current) > 0 && size+2+len(text) > telegramMessageLimit {
+			parts = append(parts, current)
+			current = nil
+			size = headerRoom
+		}
+		current = append(current, text)
+		size += 2 + len(text)
+	}
+	parts = append(parts, current)
+
+	for _, part := range parts {
+		sendBotMessage(bot, digestHeader(len(part))+"\n\n"+strings.Join(part, "\n\n"))
+	}
+}
+
+// digestHeader is the first line of a digest holding count notifications
+func digestHeader(count int) string {
+	return fmt.Sprintf("*Digest: %d notifications*", count)
+}
+
+func sendBotMessage(bot *tgbotapi.BotAPI, text string) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeMarkdown
+	_, err := bot.Send(msg)
+	if err != nil {
+		log.Printf("Error sending message to bot: %s", err)
+	}
+}
@@ -1,57 +1,188 @@
 package utils
 
 import (
+	"bytes"
+	"embed"
+	"errors"
 	"fmt"
 	"gopkg.in/gomail.v2"
+	"html/template"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	texttemplate "text/template"
 )
 
-func SendEmail(userEmail string, userName string, amount string) error {
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// emailTemplates are parsed once at startup; html/template escapes the values passed in
+var emailTemplates = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+type balanceEmailData struct {
+	Name   string
+	Amount string
+}
+
+const (
+	mailFrom               = "balance@cardinghaven.cc"
+	defaultEmailSubject    = "Payment Successful - Balance Added"
+	paymentReceivedSubject = "Payment Received"
+)
+
+// emailSubject renders EMAIL_SUBJECT_TEMPLATE, which may use {{.Name}} and {{.Amount}}, falling back to the default subject
+func emailSubject(data balanceEmailData) string {
+	subjectTemplate := os.Getenv("EMAIL_SUBJECT_TEMPLATE")
+	if subjectTemplate == "" {
+		return defaultEmailSubject
+	}
+
+	tmpl, err := texttemplate.New("subject").Parse(subjectTemplate)
+	if err != nil {
+		log.Printf("Invalid EMAIL_SUBJECT_TEMPLATE, using default subject: %s", err)
+		return defaultEmailSubject
+	}
+	var subject strings.Builder
+	if err := tmpl.Execute(&subject, data); err != nil {
+		log.Printf("Error rendering EMAIL_SUBJECT_TEMPLATE, using default subject: %s", err)
+		return defaultEmailSubject
+	}
+	return subject.String()
+}
+
+func newMailer() (*gomail.Dialer, error) {
 	mailPass := os.Getenv("MAILGUN_PASSWORD")
 	if mailPass == "" {
-		log.Fatal("MAILGUN_PASSWORD not set in .env file")
+		return nil, errors.New("MAILGUN_PASSWORD not set in .env file")
 	}
+	return gomail.NewDialer("smtp.eu.mailgun.org", 465, mailFrom, mailPass), nil
+}
 
-	mailer := gomail.NewDialer("smtp.eu.mailgun.org", 465, "balance@cardinghaven.cc", mailPass)
+// newFallbackMailer returns the secondary SMTP server from SMTP_FALLBACK_* and its sender address, if configured
+func newFallbackMailer() (*gomail.Dialer, string, bool) {
+	host := os.Getenv("SMTP_FALLBACK_HOST")
+	if host == "" {
+		return nil, "", false
+	}
+	username := os.Getenv("SMTP_FALLBACK_USERNAME")
+	from := os.Getenv("SMTP_FALLBACK_FROM")
+	if from == "" {
+		from = username
+	}
+	if from == "" {
+		log.Printf("SMTP_FALLBACK_HOST is set but neither SMTP_FALLBACK_FROM nor SMTP_FALLBACK_USERNAME is, ignoring fallback")
+		return nil, "", false
+	}
+	mailer := gomail.NewDialer(host, GetEnvInt("SMTP_FALLBACK_PORT", 465), username, os.Getenv("SMTP_FALLBACK_PASSWORD"))
+	return mailer, from, true
+}
 
+var (
+	emailSlots     chan struct{}
+	emailSlotsOnce sync.Once
+)
+
+// acquireEmailSlot blocks until fewer than EMAIL_MAX_CONCURRENT (default 2) sends are in flight.
+// The limit is read on first use because .env is loaded after this package initialises.
+func acquireEmailSlot() {
+	emailSlotsOnce.Do(func() {
+		limit := GetEnvInt("EMAIL_MAX_CONCURRENT", 2)
+		if limit < 1 {
+			limit = 1
+		}
+		emailSlots = make(chan struct{}, limit)
+	})
+	emailSlots <- struct{}{}
+}
+
+func releaseEmailSlot() {
+	<-emailSlots
+}
+
+// dialAndSend sends message through the primary server and fails over to the fallback server when
+// that fails or is not configured. It returns the host that accepted the message.
+func dialAndSend(message *gomail.Message) (string, error) {
+	acquireEmailSlot()
+	defer releaseEmailSlot()
+
+	mailer, err := newMailer()
+	if err == nil {
+		err = mailer.DialAndSend(message)
+		if err == nil {
+			return mailer.Host, nil
+		}
+	}
+
+	fallback, from, ok := newFallbackMailer()
+	if !ok {
+		return "", err
+	}
+	log.Printf("Error sending through the primary server, trying fallback %s: %s", fallback.Host, err)
+	message.SetHeader("From", from)
+	if fallbackErr := fallback.DialAndSend(message); fallbackErr != nil {
+		return "", fmt.Errorf("primary: %v, fallback: %w", err, fallbackErr)
+	}
+	return fallback.Host, nil
+}
+
+func SendEmail(userEmail string, userName string, amount string) error {
+	data := balanceEmailData{Name: userName, Amount: amount}
+	return sendTemplateEmail(userEmail, emailSubject(data), "balance_email.html", data)
+}
+
+// SendPaymentReceivedEmail confirms a payment to a customer without an account, so it doesn't
+// mention a balance
+func SendPaymentReceivedEmail(userEmail string, amount string) error {
+	return sendTemplateEmail(userEmail, paymentReceivedSubject, "payment_received_email.html", balanceEmailData{Amount: amount})
+}
+
+func sendTemplateEmail(userEmail, subject, templateName string, data balanceEmailData) error {
 	message := gomail.NewMessage()
-	message.SetHeader("From", "balance@cardinghaven.cc")
+	message.SetHeader("From", mailFrom)
 	message.SetHeader("To", userEmail)
-	message.SetHeader("Subject", "Payment Successful - Balance Added")
-	message.SetBody("text/html", fmt.Sprintf(`
-<div style="font-family: Arial, sans-serif; font-size: 16px; color: #444; background-color: #f9f9f9; padding: 20px; border: 1px solid #ddd; border-radius: 5px; max-width: 600px; margin: auto;">
-    <div style="text-align: center; margin-bottom: 20px;">
-        <h2 style="color: #4CAF50;">Hi %s,</h2>
-    </div>
-    <div style="text-align: center; margin-bottom: 20px;">
-        <h1 style="color: #3B5998; font-size: 28px;">Payment Successful!</h1>
-        <p style="font-size: 16px; line-height: 1.5; color: #555;">Your payment of <strong>$%s</strong> has been processed and added to your account balance.</p>
-    </div>
-    <div style="text-align: center; margin-bottom: 20px;">
-        <p style="font-size: 16px; color: #555;">We appreciate your trust and look forward to serving you. Explore our platform to make the most of your balance.</p>
-    </div>
-    <div style="text-align: center; margin-bottom: 20px;">
-        <img src="https://i.ibb.co/c6m0syN/cardshaven.png" width="120" height="120" alt="Carders Haven Logo" style="border-radius: 50%; margin-top: 10px;">
-    </div>
-    <div style="text-align: center; margin-bottom: 20px;">
-        <p style="font-size: 16px;">
-            <a href="https://t.me/stardyl" style="color: #007BFF; text-decoration: none;"><strong>Contact Us on Telegram</strong></a>
-        </p>
-        <p style="font-size: 14px; color: #777;">Thank you for your support!</p>
-    </div>
-</div>
-`, userName, amount))
+	message.SetHeader("Subject", subject)
+	var body bytes.Buffer
+	err := emailTemplates.ExecuteTemplate(&body, templateName, data)
+	if err != nil {
+		return fmt.Errorf("could not render email: %w", err)
+	}
+	message.SetBody("text/html", body.String())
 
 	// Additional logging
 	fmt.Println("Attempting to send email...")
 	//fmt.Printf("To: %s\nSubject: %s\n", userEmail, message.GetHeader("Subject"))
 
-	if err := mailer.DialAndSend(message); err != nil {
-		fmt.Printf("Error sending email to %s: %v\n", userEmail, err)
+	server, err := dialAndSend(message)
+	if err != nil {
+		fmt.Printf("Error sending email to %s: %v\n", MaskEmail(userEmail), err)
 		return fmt.Errorf("could not send email: %w", err)
 	}
 
-	fmt.Println("Email sent successfully")
+	fmt.Printf("Email sent successfully via %s\n", server)
 	return nil
 }
+
+// SendTestEmail sends a plain test message to recipient through the primary server only, so a
+// broken primary is reported instead of being hidden by the fallback. It returns the SMTP host used.
+func SendTestEmail(recipient string) (string, error) {
+	mailer, err := newMailer()
+	if err != nil {
+		return "", err
+	}
+
+	message := gomail.NewMessage()
+	message.SetHeader("From", mailFrom)
+	message.SetHeader("To", recipient)
+	message.SetHeader("Subject", "SMTP Test")
+	message.SetBody("text/plain", "This is a test email from the payment service. SMTP is configured correctly.")
+
+	acquireEmailSlot()
+	defer releaseEmailSlot()
+
+	err = mailer.DialAndSend(message)
+	if err != nil {
+		return "", fmt.Errorf("could not send test email through %s: %w", mailer.Host, err)
+	}
+	return mailer.Host, nil
+}
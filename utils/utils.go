@@ -2,13 +2,16 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -57,6 +60,74 @@ func ParseFloat(s string) (float64, error) {
 	return strconv.ParseFloat(s, 64)
 }
 
+// GetEnvBool returns the boolean value of the environment variable key, or fallback if it is unset or invalid
+func GetEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %s, using default %t", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// GetEnvInt returns the integer value of the environment variable key, or fallback if it is unset or invalid
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %s, using default %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// GetEnvFloat returns the float value of the environment variable key, or fallback if it is unset or invalid
+func GetEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := ParseFloat(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %s, using default %f", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// GetEnvList returns the comma separated values of the environment variable key, skipping empty entries
+func GetEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// MaskEmails hides most of each email address in log output when set
+var MaskEmails bool
+
+// MaskEmail returns email as "j***@example.com" when MaskEmails is set, and unchanged otherwise
+func MaskEmail(email string) string {
+	if !MaskEmails {
+		return email
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
 func GetCurrentTime() time.Time {
 	return time.Now()
 }
@@ -105,6 +176,44 @@ func GetBlockonomicsRate() (float64, error) {
 	return bitcoinUSDPrice, nil
 }
 
+// SatoshisToCents converts a satoshi amount to whole US cents at the given BTC/USD rate
+func SatoshisToCents(satoshis int64, rate float64) int64 {
+	return int64(math.Round(float64(satoshis) * rate / 1e6))
+}
+
+// DollarsToCents converts a USD amount to whole cents
+func DollarsToCents(dollars float64) int64 {
+	return int64(math.Round(dollars * 100))
+}
+
+// FormatCents formats a cent amount as dollars with exactly two decimals, e.g. 1205 as "12.05"
+func FormatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// defaultExplorerURLs are the address explorers used when <CURRENCY>_EXPLORER_URL is not set
+var defaultExplorerURLs = map[string]string{
+	"BTC":  "https://mempool.space/address/",
+	"USDT": "https://tronscan.org/#/address/",
+}
+
+// ExplorerURL returns a block explorer link for address, e.g. ExplorerURL("BTC", addr)
+func ExplorerURL(currency, address string) string {
+	base := os.Getenv(currency + "_EXPLORER_URL")
+	if base == "" {
+		base = defaultExplorerURLs[currency]
+	}
+	if base == "" {
+		return ""
+	}
+	return base + address
+}
+
 func ConvertToBitcoinUSD(priceInUSD float64) (float64, error) {
 	bitcoinUSDPrice, err := GetBlockonomicsRate()
 	if err != nil {